@@ -0,0 +1,569 @@
+package mixpanel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mixpanel's documented limits for a single /import or /engage request.
+const (
+	maxBatchEvents = 2000
+	maxBatchBytes  = 2 * 1024 * 1024
+)
+
+// OverflowPolicy controls what BatchClient.Enqueue does once the in-memory
+// queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes Enqueue block until space is available or its
+	// context is done. This is the default.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropOldest discards the oldest queued item to make room for
+	// the new one instead of blocking.
+	OverflowDropOldest
+)
+
+// BatchClientConfig configures a BatchClient.
+type BatchClientConfig struct {
+	// MaxBatchSize is the max number of events or updates sent per flush.
+	// Defaults to, and is clamped to, 2000: Mixpanel's per-request limit.
+	MaxBatchSize int
+
+	// MaxBatchBytes is the max marshaled payload size per flush. Defaults
+	// to, and is clamped to, 2MB: Mixpanel's per-request limit.
+	MaxBatchBytes int
+
+	// FlushInterval is how often a non-empty batch is flushed even if
+	// MaxBatchSize/MaxBatchBytes haven't been reached. Defaults to 5s.
+	FlushInterval time.Duration
+
+	// QueueSize bounds the number of items buffered in memory per queue
+	// (events and user updates are queued separately). Defaults to 10000.
+	QueueSize int
+
+	// Workers is the number of goroutines flushing batches concurrently,
+	// per queue. Defaults to 1.
+	Workers int
+
+	// Overflow controls Enqueue's behavior once QueueSize is reached.
+	// Defaults to OverflowBlock.
+	Overflow OverflowPolicy
+
+	// MaxRetries is how many times a failed flush is retried, with
+	// exponential backoff, before giving up and calling OnError. Defaults
+	// to 3.
+	MaxRetries int
+
+	// RetryBaseDelay is the delay before the first retry; each subsequent
+	// retry doubles it. Defaults to 500ms.
+	RetryBaseDelay time.Duration
+
+	// OnFailedRecords is called with the records Mixpanel rejected from a
+	// batch (parsed from the verbose response's failed_records), so callers
+	// can persist them for later retry. May be called concurrently from
+	// different workers.
+	OnFailedRecords func(kind string, failed []FailedRecord)
+
+	// OnError is called when a flush ultimately fails after all retries are
+	// exhausted. May be called concurrently from different workers.
+	OnError func(kind string, err error)
+}
+
+func (c *BatchClientConfig) setDefaults() {
+	if c.MaxBatchSize <= 0 || c.MaxBatchSize > maxBatchEvents {
+		c.MaxBatchSize = maxBatchEvents
+	}
+	if c.MaxBatchBytes <= 0 || c.MaxBatchBytes > maxBatchBytes {
+		c.MaxBatchBytes = maxBatchBytes
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = 5 * time.Second
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 10000
+	}
+	if c.Workers <= 0 {
+		c.Workers = 1
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = 3
+	} else if c.MaxRetries < 0 {
+		c.MaxRetries = 0
+	}
+	if c.RetryBaseDelay <= 0 {
+		c.RetryBaseDelay = 500 * time.Millisecond
+	}
+}
+
+// internalSender is implemented by *mixpanel. BatchClient asserts the
+// Mixpanel client it wraps against this interface to build and POST array
+// payloads, which aren't part of the public Mixpanel interface.
+type internalSender interface {
+	eventToParams(distinctID, eventName string, e *Event) map[string]interface{}
+	importEventToParams(distinctID, eventName string, e *Event) map[string]interface{}
+	updateToParams(distinctID string, u *Update) map[string]interface{}
+	sendImport(ctx context.Context, params interface{}, autoGeolocate bool) error
+	sendEngageBatch(ctx context.Context, params []map[string]interface{}) error
+}
+
+// batchEvent is a queued Track/Import call, along with its cached marshaled
+// size so workers don't re-marshal just to track the byte bound.
+type batchEvent struct {
+	distinctID string
+	eventName  string
+	event      *Event
+	size       int
+}
+
+// batchUpdate is a queued UpdateUser call.
+type batchUpdate struct {
+	distinctID string
+	update     *Update
+	size       int
+}
+
+// flushRequest asks a worker to flush its current batch immediately; done is
+// closed once the flush (including retries) completes.
+type flushRequest struct {
+	done chan struct{}
+}
+
+// ErrBatchClientClosed is returned by Enqueue/EnqueueUpdate once Close has
+// been called.
+var ErrBatchClientClosed = errors.New("mixpanel: batch client is closed")
+
+// BatchClient wraps a Mixpanel client with an asynchronous, buffered batch
+// sender. Track/Import calls are queued and flushed to /import, and
+// UpdateUser calls are queued and flushed to /engage, whenever MaxBatchSize
+// events are queued, MaxBatchBytes is reached, or FlushInterval elapses.
+//
+// BatchClient is safe for concurrent use.
+type BatchClient struct {
+	sender internalSender
+	cfg    BatchClientConfig
+
+	events    chan batchEvent
+	updates   chan batchUpdate
+	eventCtl  []chan flushRequest
+	updateCtl []chan flushRequest
+
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	eventOverflowMu  sync.Mutex
+	updateOverflowMu sync.Mutex
+}
+
+// NewBatchClient starts a BatchClient backed by client, using cfg for
+// queue sizing, flush triggers and retry behavior. Zero-valued fields in cfg
+// fall back to sensible defaults. client must have been created by this
+// package's New*/NewFromClient* constructors.
+func NewBatchClient(client Mixpanel, cfg BatchClientConfig) (*BatchClient, error) {
+	sender, ok := client.(internalSender)
+	if !ok {
+		return nil, fmt.Errorf("mixpanel: BatchClient requires a client created by this package's constructors")
+	}
+
+	cfg.setDefaults()
+
+	bc := &BatchClient{
+		sender:  sender,
+		cfg:     cfg,
+		events:  make(chan batchEvent, cfg.QueueSize),
+		updates: make(chan batchUpdate, cfg.QueueSize),
+		closed:  make(chan struct{}),
+	}
+
+	for i := 0; i < cfg.Workers; i++ {
+		ctl := make(chan flushRequest)
+		bc.eventCtl = append(bc.eventCtl, ctl)
+		bc.wg.Add(1)
+		go bc.runEvents(ctl)
+	}
+
+	for i := 0; i < cfg.Workers; i++ {
+		ctl := make(chan flushRequest)
+		bc.updateCtl = append(bc.updateCtl, ctl)
+		bc.wg.Add(1)
+		go bc.runUpdates(ctl)
+	}
+
+	return bc, nil
+}
+
+// Enqueue queues a Track/Import call for later batched delivery to /import.
+// It returns ErrBatchClientClosed if Close has already been called, or
+// ctx.Err() if the queue is full and OverflowBlock is in effect.
+func (bc *BatchClient) Enqueue(ctx context.Context, distinctID, eventName string, e *Event) error {
+	data, err := json.Marshal(bc.sender.importEventToParams(distinctID, eventName, e))
+	if err != nil {
+		return err
+	}
+	item := batchEvent{distinctID: distinctID, eventName: eventName, event: e, size: len(data)}
+
+	select {
+	case <-bc.closed:
+		return ErrBatchClientClosed
+	default:
+	}
+
+	if bc.cfg.Overflow == OverflowDropOldest {
+		bc.eventOverflowMu.Lock()
+		defer bc.eventOverflowMu.Unlock()
+		select {
+		case bc.events <- item:
+		default:
+			select {
+			case <-bc.events:
+			default:
+			}
+			bc.events <- item
+		}
+		return nil
+	}
+
+	select {
+	case bc.events <- item:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-bc.closed:
+		return ErrBatchClientClosed
+	}
+}
+
+// EnqueueUpdate queues an UpdateUser call for later batched delivery to
+// /engage. Semantics match Enqueue.
+func (bc *BatchClient) EnqueueUpdate(ctx context.Context, distinctID string, u *Update) error {
+	data, err := json.Marshal(bc.sender.updateToParams(distinctID, u))
+	if err != nil {
+		return err
+	}
+	item := batchUpdate{distinctID: distinctID, update: u, size: len(data)}
+
+	select {
+	case <-bc.closed:
+		return ErrBatchClientClosed
+	default:
+	}
+
+	if bc.cfg.Overflow == OverflowDropOldest {
+		bc.updateOverflowMu.Lock()
+		defer bc.updateOverflowMu.Unlock()
+		select {
+		case bc.updates <- item:
+		default:
+			select {
+			case <-bc.updates:
+			default:
+			}
+			bc.updates <- item
+		}
+		return nil
+	}
+
+	select {
+	case bc.updates <- item:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-bc.closed:
+		return ErrBatchClientClosed
+	}
+}
+
+// Flush blocks until every worker has flushed its currently buffered items,
+// or ctx is done.
+func (bc *BatchClient) Flush(ctx context.Context) error {
+	all := make([]chan flushRequest, 0, len(bc.eventCtl)+len(bc.updateCtl))
+	all = append(all, bc.eventCtl...)
+	all = append(all, bc.updateCtl...)
+
+	for _, ctl := range all {
+		req := flushRequest{done: make(chan struct{})}
+		select {
+		case ctl <- req:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case <-req.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Close flushes any buffered items and stops all workers. It blocks until
+// that completes or ctx is done.
+func (bc *BatchClient) Close(ctx context.Context) error {
+	flushErr := bc.Flush(ctx)
+
+	bc.closeOnce.Do(func() {
+		close(bc.closed)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		bc.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if flushErr == nil {
+			flushErr = ctx.Err()
+		}
+	}
+
+	return flushErr
+}
+
+func (bc *BatchClient) runEvents(ctl chan flushRequest) {
+	defer bc.wg.Done()
+
+	var batch []batchEvent
+	var bytes int
+	ticker := time.NewTicker(bc.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		// sendEventBatch returns any records worth retrying; keep them for
+		// the next flush cycle instead of sending them back through
+		// bc.events, which this goroutine is the sole reader of.
+		batch = bc.sendEventBatch(batch)
+		bytes = 0
+		for _, item := range batch {
+			bytes += item.size
+		}
+	}
+
+	for {
+		select {
+		case item := <-bc.events:
+			if len(batch) > 0 && bytes+item.size > bc.cfg.MaxBatchBytes {
+				flush()
+			}
+			batch = append(batch, item)
+			bytes += item.size
+			if len(batch) >= bc.cfg.MaxBatchSize || bytes >= bc.cfg.MaxBatchBytes {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case req := <-ctl:
+			flush()
+			close(req.done)
+		case <-bc.closed:
+			bc.drainEvents(&batch, &bytes)
+			flush()
+			return
+		}
+	}
+}
+
+func (bc *BatchClient) drainEvents(batch *[]batchEvent, bytes *int) {
+	for {
+		select {
+		case item := <-bc.events:
+			*batch = append(*batch, item)
+			*bytes += item.size
+		default:
+			return
+		}
+	}
+}
+
+func (bc *BatchClient) runUpdates(ctl chan flushRequest) {
+	defer bc.wg.Done()
+
+	var batch []batchUpdate
+	var bytes int
+	ticker := time.NewTicker(bc.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		// sendUpdateBatch returns any records worth retrying; keep them for
+		// the next flush cycle instead of sending them back through
+		// bc.updates, which this goroutine is the sole reader of.
+		batch = bc.sendUpdateBatch(batch)
+		bytes = 0
+		for _, item := range batch {
+			bytes += item.size
+		}
+	}
+
+	for {
+		select {
+		case item := <-bc.updates:
+			if len(batch) > 0 && bytes+item.size > bc.cfg.MaxBatchBytes {
+				flush()
+			}
+			batch = append(batch, item)
+			bytes += item.size
+			if len(batch) >= bc.cfg.MaxBatchSize || bytes >= bc.cfg.MaxBatchBytes {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case req := <-ctl:
+			flush()
+			close(req.done)
+		case <-bc.closed:
+			bc.drainUpdates(&batch, &bytes)
+			flush()
+			return
+		}
+	}
+}
+
+func (bc *BatchClient) drainUpdates(batch *[]batchUpdate, bytes *int) {
+	for {
+		select {
+		case item := <-bc.updates:
+			*batch = append(*batch, item)
+			*bytes += item.size
+		default:
+			return
+		}
+	}
+}
+
+// sendEventBatch sends batch to /import, retrying transient failures with
+// exponential backoff. Any per-record failures worth retrying are returned
+// for the caller to fold into its next batch; the rest are reported via
+// OnFailedRecords.
+func (bc *BatchClient) sendEventBatch(batch []batchEvent) []batchEvent {
+	params := make([]map[string]interface{}, len(batch))
+	for i, item := range batch {
+		params[i] = bc.sender.importEventToParams(item.distinctID, item.eventName, item.event)
+	}
+
+	err := bc.withRetry(func() error {
+		return bc.sender.sendImport(context.Background(), params, false)
+	})
+
+	retryIdx := bc.handleBatchResult("import", err, len(batch))
+	if len(retryIdx) == 0 {
+		return nil
+	}
+
+	requeued := make([]batchEvent, len(retryIdx))
+	for i, idx := range retryIdx {
+		requeued[i] = batch[idx]
+	}
+	return requeued
+}
+
+// sendUpdateBatch sends batch to /engage. See sendEventBatch.
+func (bc *BatchClient) sendUpdateBatch(batch []batchUpdate) []batchUpdate {
+	params := make([]map[string]interface{}, len(batch))
+	for i, item := range batch {
+		params[i] = bc.sender.updateToParams(item.distinctID, item.update)
+	}
+
+	err := bc.withRetry(func() error {
+		return bc.sender.sendEngageBatch(context.Background(), params)
+	})
+
+	retryIdx := bc.handleBatchResult("engage", err, len(batch))
+	if len(retryIdx) == 0 {
+		return nil
+	}
+
+	requeued := make([]batchUpdate, len(retryIdx))
+	for i, idx := range retryIdx {
+		requeued[i] = batch[idx]
+	}
+	return requeued
+}
+
+// withRetry retries send on 429/5xx responses with exponential backoff, up
+// to cfg.MaxRetries times.
+func (bc *BatchClient) withRetry(send func() error) error {
+	delay := bc.cfg.RetryBaseDelay
+
+	for attempt := 0; ; attempt++ {
+		err := send()
+		if err == nil || !isRetryableErr(err) || attempt >= bc.cfg.MaxRetries {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// handleBatchResult reports a flush's outcome and returns the indices (into
+// the original batch) of any records worth retrying. Non-retryable failed
+// records are handed to OnFailedRecords, and a non-partial error is handed
+// to OnError.
+func (bc *BatchClient) handleBatchResult(kind string, err error, batchLen int) []int {
+	if err == nil {
+		return nil
+	}
+
+	var partial *ErrImportPartialFailure
+	if errors.As(err, &partial) {
+		var retryIdx []int
+		var toReport []FailedRecord
+		for _, fr := range partial.FailedRecords {
+			if fr.Index < 0 || fr.Index >= batchLen {
+				continue
+			}
+			if isRetryableFailedRecord(fr) {
+				retryIdx = append(retryIdx, fr.Index)
+			} else {
+				toReport = append(toReport, fr)
+			}
+		}
+		if len(toReport) > 0 && bc.cfg.OnFailedRecords != nil {
+			bc.cfg.OnFailedRecords(kind, toReport)
+		}
+		return retryIdx
+	}
+
+	if bc.cfg.OnError != nil {
+		bc.cfg.OnError(kind, err)
+	}
+	return nil
+}
+
+// isRetryableErr reports whether err is a transport-level failure (429 or
+// 5xx) worth retrying the whole batch for.
+func isRetryableErr(err error) bool {
+	var trackErr *ErrTrackFailed
+	if errors.As(err, &trackErr) {
+		return trackErr.HTTPCode == 429 || trackErr.HTTPCode >= 500
+	}
+	return false
+}
+
+// isRetryableFailedRecord reports whether a single failed record looks
+// transient (e.g. rate limited) rather than a permanent rejection (e.g. a
+// malformed or duplicate event), based on Mixpanel's failure message. This
+// intentionally doesn't match on the bare word "retry": permanent-rejection
+// messages like "duplicate event, do not retry" contain it too, and since a
+// requeued record gets a fresh retry budget every flush cycle, matching too
+// broadly here would retry such records forever instead of ever reporting
+// them via OnFailedRecords.
+func isRetryableFailedRecord(fr FailedRecord) bool {
+	msg := strings.ToLower(fr.Message)
+	return strings.Contains(msg, "rate limit") || strings.Contains(msg, "too many requests")
+}
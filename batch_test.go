@@ -0,0 +1,169 @@
+package mixpanel
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransport is an http.RoundTripper whose response for the Nth request
+// is responses[N] (or the last entry, once exhausted).
+type fakeTransport struct {
+	mu        sync.Mutex
+	responses []func(*http.Request) *http.Response
+	requests  []*http.Request
+}
+
+func (f *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, req)
+
+	idx := len(f.requests) - 1
+	if idx >= len(f.responses) {
+		idx = len(f.responses) - 1
+	}
+	return f.responses[idx](req), nil
+}
+
+func (f *fakeTransport) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+func okResponse(*http.Request) *http.Response {
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(strings.NewReader(`{"status":"OK"}`)),
+		Header:     make(http.Header),
+	}
+}
+
+// rateLimitedResponse marks every record in the request body as
+// rate-limited, which BatchClient treats as retryable.
+func rateLimitedResponse(req *http.Request) *http.Response {
+	body, _ := ioutil.ReadAll(req.Body)
+
+	n := strings.Count(string(body), `"distinct_id"`) + strings.Count(string(body), `"$distinct_id"`)
+	if n == 0 {
+		n = 1
+	}
+
+	records := make([]string, n)
+	for i := range records {
+		records[i] = fmt.Sprintf(`{"index":%d,"$insert_id":"x","message":"rate limited, please retry"}`, i)
+	}
+
+	respBody := fmt.Sprintf(`{"status":"0","error":"rate limited","failed_records":[%s]}`, strings.Join(records, ","))
+	return &http.Response{
+		StatusCode: 429,
+		Body:       ioutil.NopCloser(strings.NewReader(respBody)),
+		Header:     make(http.Header),
+	}
+}
+
+func newTestBatchClient(t *testing.T, transport *fakeTransport, cfg BatchClientConfig) *BatchClient {
+	t.Helper()
+
+	client := NewFromClient(&http.Client{Transport: transport}, "token", "http://mixpanel.test")
+	bc, err := NewBatchClient(client, cfg)
+	if err != nil {
+		t.Fatalf("NewBatchClient: %v", err)
+	}
+	return bc
+}
+
+func TestBatchClient_FlushOnMaxBatchSize(t *testing.T) {
+	transport := &fakeTransport{responses: []func(*http.Request) *http.Response{okResponse}}
+	bc := newTestBatchClient(t, transport, BatchClientConfig{
+		MaxBatchSize:  3,
+		FlushInterval: time.Hour, // large enough to not fire during the test
+	})
+	defer bc.Close(context.Background())
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := bc.Enqueue(ctx, "user", "event", &Event{}); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+
+	deadline := time.After(2 * time.Second)
+	for transport.requestCount() == 0 {
+		select {
+		case <-deadline:
+			t.Fatal("expected a flush once MaxBatchSize was reached")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestBatchClient_FlushOnInterval(t *testing.T) {
+	transport := &fakeTransport{responses: []func(*http.Request) *http.Response{okResponse}}
+	bc := newTestBatchClient(t, transport, BatchClientConfig{
+		MaxBatchSize:  1000,
+		FlushInterval: 20 * time.Millisecond,
+	})
+	defer bc.Close(context.Background())
+
+	if err := bc.Enqueue(context.Background(), "user", "event", &Event{}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	deadline := time.After(2 * time.Second)
+	for transport.requestCount() == 0 {
+		select {
+		case <-deadline:
+			t.Fatal("expected FlushInterval to trigger a flush")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// TestBatchClient_RequeueDoesNotDeadlockOnFullQueue is a regression test: a
+// worker that re-enqueues retryable failed records must not block on the
+// very channel it is the sole reader of, or Flush/Close hang forever.
+func TestBatchClient_RequeueDoesNotDeadlockOnFullQueue(t *testing.T) {
+	transport := &fakeTransport{responses: []func(*http.Request) *http.Response{rateLimitedResponse}}
+	bc := newTestBatchClient(t, transport, BatchClientConfig{
+		MaxBatchSize:  2,
+		FlushInterval: 10 * time.Millisecond,
+		QueueSize:     1,
+	})
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := bc.Enqueue(ctx, "user", "event", &Event{}); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		flushCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		done <- bc.Flush(flushCtx)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Flush deadlocked requeuing rate-limited records into a full queue")
+	}
+
+	closeCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := bc.Close(closeCtx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package mixpanel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// capturedBody decodes the array payload most recently sent to transport.
+func capturedBody(t *testing.T, transport *fakeTransport) []map[string]interface{} {
+	t.Helper()
+	if len(transport.requests) == 0 {
+		t.Fatalf("no request was sent")
+	}
+	req := transport.requests[len(transport.requests)-1]
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("reading request body: %v", err)
+	}
+
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		t.Fatalf("decoding request body: %v", err)
+	}
+	return decoded
+}
+
+func TestUpdateUserBatch_PayloadShape(t *testing.T) {
+	transport := &fakeTransport{responses: []func(*http.Request) *http.Response{okResponse}}
+	client := NewFromClient(&http.Client{Transport: transport}, "token", "http://mixpanel.test")
+
+	updates := []UserUpdate{
+		{DistinctID: "user1", Update: &Update{Operation: "$set", Properties: map[string]interface{}{"plan": "pro"}}},
+		{DistinctID: "user2", Update: &Update{Operation: "$set", Properties: map[string]interface{}{"plan": "free"}}},
+	}
+
+	if err := client.UpdateUserBatch(context.Background(), updates); err != nil {
+		t.Fatalf("UpdateUserBatch: %v", err)
+	}
+
+	if got := transport.requests[0].URL.Path; got != "/engage" {
+		t.Fatalf("request path = %q, want /engage", got)
+	}
+
+	decoded := capturedBody(t, transport)
+	if len(decoded) != 2 {
+		t.Fatalf("got %d records, want 2", len(decoded))
+	}
+	for i, want := range []string{"user1", "user2"} {
+		if got := decoded[i]["$distinct_id"]; got != want {
+			t.Fatalf("record %d $distinct_id = %v, want %v", i, got, want)
+		}
+		if got := decoded[i]["$token"]; got != "token" {
+			t.Fatalf("record %d $token = %v, want token", i, got)
+		}
+	}
+}
+
+func TestUpdateGroupBatch_PayloadShape(t *testing.T) {
+	transport := &fakeTransport{responses: []func(*http.Request) *http.Response{okResponse}}
+	client := NewFromClient(&http.Client{Transport: transport}, "token", "http://mixpanel.test")
+
+	updates := []GroupUpdate{
+		{GroupKey: "company", GroupID: "acme", Update: &Update{Operation: "$set", Properties: map[string]interface{}{"plan": "pro"}}},
+	}
+
+	if err := client.UpdateGroupBatch(context.Background(), updates); err != nil {
+		t.Fatalf("UpdateGroupBatch: %v", err)
+	}
+
+	if got := transport.requests[0].URL.Path; got != "/groups" {
+		t.Fatalf("request path = %q, want /groups", got)
+	}
+
+	decoded := capturedBody(t, transport)
+	if len(decoded) != 1 {
+		t.Fatalf("got %d records, want 1", len(decoded))
+	}
+	if got := decoded[0]["$group_key"]; got != "company" {
+		t.Fatalf("$group_key = %v, want company", got)
+	}
+	if got := decoded[0]["$group_id"]; got != "acme" {
+		t.Fatalf("$group_id = %v, want acme", got)
+	}
+}
+
+func TestUpdateUserBatch_Empty(t *testing.T) {
+	transport := &fakeTransport{responses: []func(*http.Request) *http.Response{okResponse}}
+	client := NewFromClient(&http.Client{Transport: transport}, "token", "http://mixpanel.test")
+
+	if err := client.UpdateUserBatch(context.Background(), nil); err != nil {
+		t.Fatalf("UpdateUserBatch(nil): %v", err)
+	}
+	if transport.requestCount() != 0 {
+		t.Fatalf("expected no request for an empty batch, got %d", transport.requestCount())
+	}
+}
+
+// partialFailureResponse reports the record at index as rejected for reason,
+// leaving the rest unmentioned (i.e. accepted).
+func partialFailureResponse(index int, reason string) func(*http.Request) *http.Response {
+	return func(*http.Request) *http.Response {
+		body := fmt.Sprintf(`{"status":"0","error":"partial failure","failed_records":[{"index":%d,"$insert_id":"x","message":%q}]}`, index, reason)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+			Header:     make(http.Header),
+		}
+	}
+}
+
+func TestUpdateGroupBatch_PartialFailureIsReturnedAsError(t *testing.T) {
+	transport := &fakeTransport{responses: []func(*http.Request) *http.Response{partialFailureResponse(0, "malformed payload, do not retry")}}
+	client := NewFromClient(&http.Client{Transport: transport}, "token", "http://mixpanel.test")
+
+	updates := []GroupUpdate{
+		{GroupKey: "company", GroupID: "acme", Update: &Update{Operation: "$set", Properties: map[string]interface{}{"plan": "pro"}}},
+	}
+
+	err := client.UpdateGroupBatch(context.Background(), updates)
+	if err == nil {
+		t.Fatalf("expected an error for a rejected record")
+	}
+
+	var partial *ErrImportPartialFailure
+	if !errors.As(err, &partial) {
+		t.Fatalf("got err %v, want it to unwrap to *ErrImportPartialFailure", err)
+	}
+	if len(partial.FailedRecords) != 1 || partial.FailedRecords[0].Message != "malformed payload, do not retry" {
+		t.Fatalf("FailedRecords = %+v, want one record with the rejection message", partial.FailedRecords)
+	}
+}
@@ -0,0 +1,64 @@
+package mixpanel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeInsertID_StableForIdenticalInput(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+	e := &Event{Timestamp: &ts, Properties: map[string]interface{}{"a": 1, "b": "x"}}
+
+	got1 := computeInsertID("user1", "event1", e)
+	got2 := computeInsertID("user1", "event1", e)
+
+	if got1 != got2 {
+		t.Fatalf("computeInsertID is not stable across calls: %q != %q", got1, got2)
+	}
+}
+
+func TestComputeInsertID_StableRegardlessOfPropertyOrder(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+	e1 := &Event{Timestamp: &ts, Properties: map[string]interface{}{"a": 1, "b": "x", "c": true}}
+	e2 := &Event{Timestamp: &ts, Properties: map[string]interface{}{"c": true, "a": 1, "b": "x"}}
+
+	got1 := computeInsertID("user1", "event1", e1)
+	got2 := computeInsertID("user1", "event1", e2)
+
+	if got1 != got2 {
+		t.Fatalf("computeInsertID should be independent of map iteration order: %q != %q", got1, got2)
+	}
+}
+
+func TestComputeInsertID_DiffersOnMeaningfulChange(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+	base := &Event{Timestamp: &ts, Properties: map[string]interface{}{"a": 1}}
+	id := computeInsertID("user1", "event1", base)
+
+	variants := map[string]string{
+		"distinct id":    computeInsertID("user2", "event1", base),
+		"event name":     computeInsertID("user1", "event2", base),
+		"timestamp":      computeInsertID("user1", "event1", &Event{Timestamp: &[]time.Time{ts.Add(time.Second)}[0], Properties: base.Properties}),
+		"property value": computeInsertID("user1", "event1", &Event{Timestamp: &ts, Properties: map[string]interface{}{"a": 2}}),
+	}
+
+	for name, other := range variants {
+		if other == id {
+			t.Fatalf("changing %s did not change the computed insert id", name)
+		}
+	}
+}
+
+func TestComputeInsertID_LengthAndCharset(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+	id := computeInsertID("user1", "event1", &Event{Timestamp: &ts, Properties: nil})
+
+	if len(id) != 32 {
+		t.Fatalf("got insert id length %d, want 32", len(id))
+	}
+	for _, r := range id {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			t.Fatalf("insert id %q contains non-hex character %q", id, r)
+		}
+	}
+}
@@ -2,11 +2,15 @@ package mixpanel
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -44,6 +48,43 @@ func (err *ErrTrackFailed) Error() string {
 	return fmt.Sprintf("mixpanel did not return 1 when tracking: %s", err.Message)
 }
 
+// defaultImportThreshold matches the age at which Mixpanel's /track endpoint
+// starts silently dropping events.
+const defaultImportThreshold = 5 * 24 * time.Hour
+
+// ErrImportAuthRequired is returned by Track when an event is old enough to
+// require falling back to /import, but no Secret was configured to
+// authenticate that request.
+type ErrImportAuthRequired struct {
+	DistinctID string
+	EventName  string
+}
+
+func (err *ErrImportAuthRequired) Error() string {
+	return fmt.Sprintf("mixpanel: event %q for distinct id %q is too old for /track and needs a Secret to fall back to /import", err.EventName, err.DistinctID)
+}
+
+// FailedRecord describes one record Mixpanel rejected from a batch request,
+// as reported in the verbose /import response's failed_records array.
+type FailedRecord struct {
+	Index    int    `json:"index"`
+	InsertID string `json:"$insert_id"`
+	Message  string `json:"message"`
+}
+
+// ErrImportPartialFailure is returned when Mixpanel accepted a /import batch
+// but rejected some of its records; FailedRecords reports which ones and why
+// so callers can inspect, persist or retry them.
+type ErrImportPartialFailure struct {
+	FailedRecords []FailedRecord
+	Body          []byte
+	HTTPCode      int
+}
+
+func (err *ErrImportPartialFailure) Error() string {
+	return fmt.Sprintf("mixpanel: %d record(s) failed to import", len(err.FailedRecords))
+}
+
 // The Mixapanel struct store the mixpanel endpoint and the project token
 type Mixpanel interface {
 	// Create a mixpanel event using the track api
@@ -61,9 +102,15 @@ type Mixpanel interface {
 	// Set properties for a mixpanel user.
 	UpdateUser(ctx context.Context, distinctId string, u *Update) error
 
+	// Set properties for up to 2000 mixpanel users in a single request.
+	UpdateUserBatch(ctx context.Context, updates []UserUpdate) error
+
 	// Set properties for a mixpanel group.
 	UpdateGroup(ctx context.Context, groupKey, groupId string, u *Update) error
 
+	// Set properties for up to 2000 mixpanel groups in a single request.
+	UpdateGroupBatch(ctx context.Context, updates []GroupUpdate) error
+
 	// Create an alias for an existing distinct id
 	Alias(ctx context.Context, distinctId, newId string) error
 }
@@ -74,6 +121,99 @@ type mixpanel struct {
 	Token  string
 	Secret string
 	ApiURL string
+
+	// Username is the service account username. When set, requests are
+	// authenticated with Basic auth as Username:Secret instead of the
+	// legacy Secret: scheme.
+	Username string
+
+	// ProjectID is the numeric Mixpanel project id required alongside
+	// service account credentials for /import and for any EU/IN residency
+	// project.
+	ProjectID string
+
+	region Region
+
+	// ImportThreshold is how far in the past an Event.Timestamp can be
+	// before Track automatically routes it to /import instead, since
+	// /track silently drops old events. Defaults to defaultImportThreshold.
+	ImportThreshold time.Duration
+
+	// DisableImportFallback turns off the automatic /track -> /import
+	// routing for old events, restoring the previous Track behavior.
+	DisableImportFallback bool
+
+	// DisableAutoInsertID turns off automatic $insert_id generation for
+	// Import/ImportBatch, restoring the previous behavior where retries at
+	// the transport layer can duplicate events.
+	DisableAutoInsertID bool
+}
+
+// Region selects a Mixpanel data-residency endpoint. It only affects the
+// default ApiURL used when the apiURL constructor argument is blank.
+type Region string
+
+const (
+	RegionUS Region = "US"
+	RegionEU Region = "EU"
+	RegionIN Region = "IN"
+)
+
+// regionHosts maps each Region to its default API host.
+var regionHosts = map[Region]string{
+	RegionUS: "https://api.mixpanel.com",
+	RegionEU: "https://api-eu.mixpanel.com",
+	RegionIN: "https://api-in.mixpanel.com",
+}
+
+// Option configures optional behavior on a client returned by New,
+// NewWithSecret, NewFromClient or NewFromClientWithSecret.
+type Option func(*mixpanel)
+
+// WithRegion selects the data-residency endpoint to use when apiURL is left
+// blank. Defaults to RegionUS. The EU and IN endpoints are required for
+// projects hosted outside the US.
+func WithRegion(r Region) Option {
+	return func(m *mixpanel) {
+		m.region = r
+	}
+}
+
+// WithImportThreshold overrides the age after which Track routes an event to
+// /import instead of /track. The default is 5 days, matching the age at
+// which Mixpanel's /track endpoint starts dropping events.
+func WithImportThreshold(d time.Duration) Option {
+	return func(m *mixpanel) {
+		m.ImportThreshold = d
+	}
+}
+
+// WithoutImportFallback disables the automatic /track -> /import fallback for
+// old events; Track will send them to /track as-is, where Mixpanel may drop
+// them.
+func WithoutImportFallback() Option {
+	return func(m *mixpanel) {
+		m.DisableImportFallback = true
+	}
+}
+
+// WithoutAutoInsertID disables automatic $insert_id generation, so
+// Import/ImportBatch only dedupe on an explicitly set Event.InsertID.
+func WithoutAutoInsertID() Option {
+	return func(m *mixpanel) {
+		m.DisableAutoInsertID = true
+	}
+}
+
+// WithToken sets the project token embedded in event/profile/group payloads
+// (the "token"/"$token" field). NewWithServiceAccount leaves this blank,
+// since Basic auth plus ProjectID is sufficient for /import, but /track,
+// /engage and /groups all require a token too; pass WithToken alongside
+// NewWithServiceAccount to use those endpoints.
+func WithToken(token string) Option {
+	return func(m *mixpanel) {
+		m.Token = token
+	}
 }
 
 // A mixpanel event
@@ -87,6 +227,11 @@ type Event struct {
 
 	// Custom properties. At least one must be specified.
 	Properties map[string]interface{}
+
+	// InsertID, if set, is used as the event's $insert_id when imported,
+	// taking precedence over the one AutoInsertID would otherwise compute.
+	// Leave empty to let the client generate one.
+	InsertID string
 }
 
 type TrackEvent struct {
@@ -112,6 +257,19 @@ type Update struct {
 	Properties map[string]interface{}
 }
 
+// UserUpdate is one entry of an UpdateUserBatch call.
+type UserUpdate struct {
+	DistinctID string
+	Update     *Update
+}
+
+// GroupUpdate is one entry of an UpdateGroupBatch call.
+type GroupUpdate struct {
+	GroupKey string
+	GroupID  string
+	Update   *Update
+}
+
 // Alias create an alias for an existing distinct id
 func (m *mixpanel) Alias(ctx context.Context, distinctId, newId string) error {
 	props := map[string]interface{}{
@@ -152,9 +310,79 @@ func (m *mixpanel) eventToParams(distinctID, eventName string, e *Event) map[str
 	return params
 }
 
+// importEventToParams is like eventToParams, but additionally sets
+// $insert_id on events imported through /import so that retries dedupe
+// instead of creating duplicates. An explicit Event.InsertID always wins;
+// DisableAutoInsertID only turns off computing one when none is given.
+func (m *mixpanel) importEventToParams(distinctID, eventName string, e *Event) map[string]interface{} {
+	params := m.eventToParams(distinctID, eventName, e)
+
+	props, ok := params["properties"].(map[string]interface{})
+	if !ok {
+		return params
+	}
+
+	insertID := e.InsertID
+	if insertID == "" {
+		if v, ok := props["$insert_id"].(string); ok {
+			insertID = v
+		}
+	}
+	if insertID == "" && !m.DisableAutoInsertID {
+		insertID = computeInsertID(distinctID, eventName, e)
+	}
+	if insertID != "" {
+		props["$insert_id"] = insertID
+	}
+
+	return params
+}
+
+// computeInsertID derives a stable $insert_id from a SHA-256 of the
+// canonicalized event, so repeated imports of the same logical event (e.g.
+// from a retrying caller) dedupe within Mixpanel's 5-day /import window
+// instead of creating duplicates. See
+// https://developer.mixpanel.com/docs/data-pipelines-and-deduplication
+func computeInsertID(distinctID, eventName string, e *Event) string {
+	var ts int64
+	if e.Timestamp != nil {
+		ts = e.Timestamp.Unix()
+	}
+
+	// encoding/json sorts map keys alphabetically, so this is stable
+	// regardless of Properties' iteration order.
+	propsJSON, _ := json.Marshal(e.Properties)
+
+	h := sha256.New()
+	h.Write([]byte(distinctID))
+	h.Write([]byte{0})
+	h.Write([]byte(eventName))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatInt(ts, 10)))
+	h.Write([]byte{0})
+	h.Write(propsJSON)
+
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
 // Track create an event for an existing distinct id
+//
+// If e.Timestamp is older than the client's ImportThreshold (5 days by
+// default), Mixpanel's /track endpoint would silently drop the event, so
+// Track automatically routes it to /import instead, authenticated with
+// Secret. If no Secret is configured, Track returns ErrImportAuthRequired
+// rather than sending an event that will be dropped. Set
+// WithoutImportFallback to opt out of this behavior entirely.
 func (m *mixpanel) Track(ctx context.Context, distinctID, eventName string, e *Event) error {
 	autoGeolocate := e.IP == ""
+
+	if !m.DisableImportFallback && e.Timestamp != nil && time.Since(*e.Timestamp) > m.ImportThreshold {
+		if m.Secret == "" {
+			return &ErrImportAuthRequired{DistinctID: distinctID, EventName: eventName}
+		}
+		return m.sendImport(ctx, m.importEventToParams(distinctID, eventName, e), autoGeolocate)
+	}
+
 	return m.send(ctx, "track", m.eventToParams(distinctID, eventName, e), autoGeolocate)
 }
 
@@ -162,7 +390,7 @@ func (m *mixpanel) Track(ctx context.Context, distinctID, eventName string, e *E
 // See https://developer.mixpanel.com/docs/importing-old-events
 func (m *mixpanel) Import(ctx context.Context, distinctID, eventName string, e *Event) error {
 	autoGeolocate := e.IP == ""
-	return m.sendImport(ctx, m.eventToParams(distinctID, eventName, e), autoGeolocate)
+	return m.sendImport(ctx, m.importEventToParams(distinctID, eventName, e), autoGeolocate)
 }
 
 // Import batch takes a batch of events and imports them all.
@@ -174,7 +402,7 @@ func (m *mixpanel) ImportBatch(ctx context.Context, events []*TrackEvent) error
 	params := []map[string]interface{}{}
 
 	for _, event := range events {
-		params = append(params, m.eventToParams(event.DistinctID, event.EventName, event.Event))
+		params = append(params, m.importEventToParams(event.DistinctID, event.EventName, event.Event))
 	}
 
 	return m.sendImport(ctx, params, false)
@@ -187,9 +415,7 @@ func (m *mixpanel) Update(ctx context.Context, distinctId string, u *Update) err
 	return m.UpdateUser(ctx, distinctId, u)
 }
 
-// UpdateUser: Updates a user in mixpanel. See
-// https://mixpanel.com/help/reference/http#people-analytics-updates
-func (m *mixpanel) UpdateUser(ctx context.Context, distinctId string, u *Update) error {
+func (m *mixpanel) updateToParams(distinctId string, u *Update) map[string]interface{} {
 	params := map[string]interface{}{
 		"$token":       m.Token,
 		"$distinct_id": distinctId,
@@ -206,14 +432,34 @@ func (m *mixpanel) UpdateUser(ctx context.Context, distinctId string, u *Update)
 
 	params[u.Operation] = u.Properties
 
+	return params
+}
+
+// UpdateUser: Updates a user in mixpanel. See
+// https://mixpanel.com/help/reference/http#people-analytics-updates
+func (m *mixpanel) UpdateUser(ctx context.Context, distinctId string, u *Update) error {
+	params := m.updateToParams(distinctId, u)
 	autoGeolocate := u.IP == ""
 
 	return m.send(ctx, "engage", params, autoGeolocate)
 }
 
-// UpdateGroup: Updates a group in mixpanel. See
-// https://api.mixpanel.com/groups#group-set
-func (m *mixpanel) UpdateGroup(ctx context.Context, groupKey, groupId string, u *Update) error {
+// UpdateUserBatch updates up to 2000 users in a single request. See
+// https://developer.mixpanel.com/reference/profile-batch-update
+func (m *mixpanel) UpdateUserBatch(ctx context.Context, updates []UserUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+
+	params := make([]map[string]interface{}, len(updates))
+	for i, u := range updates {
+		params[i] = m.updateToParams(u.DistinctID, u.Update)
+	}
+
+	return m.sendEngageBatch(ctx, params)
+}
+
+func (m *mixpanel) groupUpdateToParams(groupKey, groupId string, u *Update) map[string]interface{} {
 	params := map[string]interface{}{
 		"$token":     m.Token,
 		"$group_id":  groupId,
@@ -222,7 +468,28 @@ func (m *mixpanel) UpdateGroup(ctx context.Context, groupKey, groupId string, u
 
 	params[u.Operation] = u.Properties
 
-	return m.send(ctx, "groups", params, false)
+	return params
+}
+
+// UpdateGroup: Updates a group in mixpanel. See
+// https://api.mixpanel.com/groups#group-set
+func (m *mixpanel) UpdateGroup(ctx context.Context, groupKey, groupId string, u *Update) error {
+	return m.send(ctx, "groups", m.groupUpdateToParams(groupKey, groupId, u), false)
+}
+
+// UpdateGroupBatch updates up to 2000 groups in a single request. See
+// https://developer.mixpanel.com/reference/group-batch-update
+func (m *mixpanel) UpdateGroupBatch(ctx context.Context, updates []GroupUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+
+	params := make([]map[string]interface{}, len(updates))
+	for i, u := range updates {
+		params[i] = m.groupUpdateToParams(u.GroupKey, u.GroupID, u.Update)
+	}
+
+	return m.sendGroupsBatch(ctx, params)
 }
 
 func (m *mixpanel) to64(data []byte) string {
@@ -230,13 +497,60 @@ func (m *mixpanel) to64(data []byte) string {
 }
 
 func (m *mixpanel) sendImport(ctx context.Context, params interface{}, autoGeolocate bool) error {
+	return m.postBatch(ctx, m.withProjectID("/import?strict=1"), params)
+}
+
+// withProjectID appends project_id to path when ProjectID is set, as
+// required alongside service account auth on every endpoint, not just
+// /import.
+func (m *mixpanel) withProjectID(path string) string {
+	if m.ProjectID == "" {
+		return path
+	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + "project_id=" + url.QueryEscape(m.ProjectID)
+}
+
+// setBasicAuth authenticates request using service account credentials
+// (Username:Secret) when Username is set, falling back to the legacy
+// Secret: scheme used by API secret auth.
+func (m *mixpanel) setBasicAuth(request *http.Request) {
+	switch {
+	case m.Username != "":
+		request.SetBasicAuth(m.Username, m.Secret)
+	case m.Secret != "":
+		request.SetBasicAuth(m.Secret, "")
+	}
+}
+
+// sendEngageBatch posts an array of up to 2000 $set/$union/etc. operations to
+// /engage in a single request. See
+// https://developer.mixpanel.com/reference/profile-batch-update
+func (m *mixpanel) sendEngageBatch(ctx context.Context, params []map[string]interface{}) error {
+	return m.postBatch(ctx, m.withProjectID("/engage?verbose=1"), params)
+}
+
+// sendGroupsBatch posts an array of up to 2000 group operations to /groups
+// in a single request. See
+// https://developer.mixpanel.com/reference/group-batch-update
+func (m *mixpanel) sendGroupsBatch(ctx context.Context, params []map[string]interface{}) error {
+	return m.postBatch(ctx, m.withProjectID("/groups?verbose=1"), params)
+}
+
+// postBatch POSTs a JSON-encoded array (or single object) payload to path and
+// parses Mixpanel's verbose response, which both /import and the /engage and
+// /groups batch endpoints share.
+func (m *mixpanel) postBatch(ctx context.Context, path string, params interface{}) error {
 	data, err := json.Marshal(params)
 
 	if err != nil {
 		return err
 	}
 
-	url := m.ApiURL + "/import?strict=1"
+	url := m.ApiURL + path
 
 	wrapErr := func(err error) error {
 		return &MixpanelError{URL: url, Err: err}
@@ -246,9 +560,7 @@ func (m *mixpanel) sendImport(ctx context.Context, params interface{}, autoGeolo
 	if err != nil {
 		return wrapErr(err)
 	}
-	if m.Secret != "" {
-		request.SetBasicAuth(m.Secret, "")
-	}
+	m.setBasicAuth(request)
 	request.Header.Set("Content-Type", "application/json")
 	resp, err := m.Client.Do(request)
 	if err != nil {
@@ -264,18 +576,25 @@ func (m *mixpanel) sendImport(ctx context.Context, params interface{}, autoGeolo
 	}
 
 	type verboseResponse struct {
-		Error  string `json:"error"`
-		Status string `json:"status"`
+		Error         string         `json:"error"`
+		Status        string         `json:"status"`
+		FailedRecords []FailedRecord `json:"failed_records"`
 	}
 
 	var jsonBody verboseResponse
 	err = json.Unmarshal(body, &jsonBody)
 	if err != nil {
+		if resp.StatusCode >= 300 {
+			errMsg := fmt.Sprintf("httpCode=%d, body=%s", resp.StatusCode, string(body))
+			return wrapErr(&ErrTrackFailed{Message: errMsg, HTTPCode: resp.StatusCode, Body: body})
+		}
 		return wrapErr(err)
 	}
 
-	// TODO(joey): If some records in the batch failed, return them so they can be retried.
 	if jsonBody.Status != "OK" {
+		if len(jsonBody.FailedRecords) > 0 {
+			return wrapErr(&ErrImportPartialFailure{FailedRecords: jsonBody.FailedRecords, HTTPCode: resp.StatusCode, Body: body})
+		}
 		errMsg := fmt.Sprintf("error=%s; status=%s; httpCode=%d, body=%s", jsonBody.Error, jsonBody.Status, resp.StatusCode, string(body))
 		return wrapErr(&ErrTrackFailed{Message: errMsg, HTTPCode: resp.StatusCode, Body: body})
 	}
@@ -290,7 +609,7 @@ func (m *mixpanel) send(ctx context.Context, eventType string, params interface{
 		return err
 	}
 
-	url := m.ApiURL + "/" + eventType + "?verbose=1"
+	url := m.ApiURL + m.withProjectID("/"+eventType+"?verbose=1")
 
 	wrapErr := func(err error) error {
 		return &MixpanelError{URL: url, Err: err}
@@ -300,9 +619,7 @@ func (m *mixpanel) send(ctx context.Context, eventType string, params interface{
 	if err != nil {
 		return wrapErr(err)
 	}
-	if m.Secret != "" {
-		request.SetBasicAuth(m.Secret, "")
-	}
+	m.setBasicAuth(request)
 	resp, err := m.Client.Do(request)
 	if err != nil {
 		return wrapErr(err)
@@ -334,32 +651,61 @@ func (m *mixpanel) send(ctx context.Context, eventType string, params interface{
 
 // New returns the client instance. If apiURL is blank, the default will be used
 // ("https://api.mixpanel.com").
-func New(token, apiURL string) Mixpanel {
-	return NewFromClient(http.DefaultClient, token, apiURL)
+func New(token, apiURL string, opts ...Option) Mixpanel {
+	return NewFromClient(http.DefaultClient, token, apiURL, opts...)
 }
 
 // NewWithSecret returns the client instance using a secret.If apiURL is blank,
 // the default will be used ("https://api.mixpanel.com").
-func NewWithSecret(token, secret, apiURL string) Mixpanel {
-	return NewFromClientWithSecret(http.DefaultClient, token, secret, apiURL)
+func NewWithSecret(token, secret, apiURL string, opts ...Option) Mixpanel {
+	return NewFromClientWithSecret(http.DefaultClient, token, secret, apiURL, opts...)
 }
 
 // NewFromClient creates a client instance using the specified client instance. This is useful
-// when using a proxy.
-func NewFromClient(c *http.Client, token, apiURL string) Mixpanel {
-	return NewFromClientWithSecret(c, token, "", apiURL)
+// when using a proxy, or to compose retry, timeout and circuit-breaker
+// behavior onto requests via c.Transport (see RetryTransport,
+// CircuitBreaker and TimeoutTransport) without wrapping the Mixpanel
+// interface itself.
+func NewFromClient(c *http.Client, token, apiURL string, opts ...Option) Mixpanel {
+	return NewFromClientWithSecret(c, token, "", apiURL, opts...)
 }
 
 // NewFromClientWithSecret creates a client instance using the specified client instance and secret.
-func NewFromClientWithSecret(c *http.Client, token, secret, apiURL string) Mixpanel {
-	if apiURL == "" {
-		apiURL = "https://api.mixpanel.com"
+func NewFromClientWithSecret(c *http.Client, token, secret, apiURL string, opts ...Option) Mixpanel {
+	m := &mixpanel{
+		Client:          c,
+		Token:           token,
+		Secret:          secret,
+		ApiURL:          apiURL,
+		ImportThreshold: defaultImportThreshold,
+		region:          RegionUS,
+	}
+
+	for _, opt := range opts {
+		opt(m)
 	}
 
-	return &mixpanel{
-		Client: c,
-		Token:  token,
-		Secret: secret,
-		ApiURL: apiURL,
+	if m.ApiURL == "" {
+		m.ApiURL = regionHosts[m.region]
 	}
+
+	return m
+}
+
+// NewWithServiceAccount returns a client authenticated with a Mixpanel
+// service account (username + secret) and scoped to projectID. This is the
+// only auth mechanism supported by the EU/IN residency endpoints and by the
+// modern /import API; pair it with WithRegion when projectID isn't on
+// RegionUS. If apiURL is blank, the default for the configured Region is
+// used.
+//
+// The returned client has no project token, so Track/UpdateUser/UpdateGroup
+// and their batch variants (which all embed a token in their payload,
+// unlike /import) will be rejected by Mixpanel unless WithToken is also
+// passed.
+func NewWithServiceAccount(username, secret, projectID, apiURL string, opts ...Option) Mixpanel {
+	m := NewFromClientWithSecret(http.DefaultClient, "", secret, apiURL, opts...).(*mixpanel)
+	m.Username = username
+	m.ProjectID = projectID
+	return m
 }
@@ -0,0 +1,83 @@
+package mixpanel
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// TestServiceAccountAuth_ProjectIDAndBasicAuth verifies that a service
+// account client (Username + Secret + ProjectID, no Token) authenticates
+// with Basic auth and sends project_id on every endpoint, not just /import.
+func TestServiceAccountAuth_ProjectIDAndBasicAuth(t *testing.T) {
+	tests := []struct {
+		name string
+		// resp is trackOkResponse for endpoints that go through send()
+		// (integer status), or okResponse for the verbose batch endpoints
+		// (string status) that postBatch expects.
+		resp func(*http.Request) *http.Response
+		call func(t *testing.T, c Mixpanel)
+	}{
+		{
+			name: "track",
+			resp: trackOkResponse,
+			call: func(t *testing.T, c Mixpanel) {
+				if err := c.Track(context.Background(), "user1", "event1", &Event{}); err != nil {
+					t.Fatalf("Track: %v", err)
+				}
+			},
+		},
+		{
+			name: "engage",
+			resp: trackOkResponse,
+			call: func(t *testing.T, c Mixpanel) {
+				if err := c.UpdateUser(context.Background(), "user1", &Update{Operation: "$set", Properties: map[string]interface{}{"a": 1}}); err != nil {
+					t.Fatalf("UpdateUser: %v", err)
+				}
+			},
+		},
+		{
+			name: "groups",
+			resp: trackOkResponse,
+			call: func(t *testing.T, c Mixpanel) {
+				if err := c.UpdateGroup(context.Background(), "company", "acme", &Update{Operation: "$set", Properties: map[string]interface{}{"a": 1}}); err != nil {
+					t.Fatalf("UpdateGroup: %v", err)
+				}
+			},
+		},
+		{
+			name: "import",
+			resp: okResponse,
+			call: func(t *testing.T, c Mixpanel) {
+				if err := c.Import(context.Background(), "user1", "event1", &Event{}); err != nil {
+					t.Fatalf("Import: %v", err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &fakeTransport{responses: []func(*http.Request) *http.Response{tt.resp}}
+			client := NewWithServiceAccount("svc-user", "svc-secret", "12345", "http://mixpanel.test", func(m *mixpanel) {
+				m.Client = &http.Client{Transport: transport}
+			})
+
+			tt.call(t, client)
+
+			if transport.requestCount() != 1 {
+				t.Fatalf("got %d requests, want 1", transport.requestCount())
+			}
+			req := transport.requests[0]
+
+			user, pass, ok := req.BasicAuth()
+			if !ok || user != "svc-user" || pass != "svc-secret" {
+				t.Fatalf("BasicAuth() = (%q, %q, %v), want (svc-user, svc-secret, true)", user, pass, ok)
+			}
+
+			if got := req.URL.Query().Get("project_id"); got != "12345" {
+				t.Fatalf("project_id query param = %q, want 12345", got)
+			}
+		})
+	}
+}
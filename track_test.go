@@ -0,0 +1,123 @@
+package mixpanel
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trackOkResponse is an okResponse for the /track, /engage and /groups
+// single-item endpoints, which report success as the integer status 1
+// rather than the verbose batch endpoints' {"status":"OK"}.
+func trackOkResponse(*http.Request) *http.Response {
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(strings.NewReader(`{"status":1}`)),
+		Header:     make(http.Header),
+	}
+}
+
+func TestTrack_ImportFallback(t *testing.T) {
+	old := time.Now().Add(-10 * 24 * time.Hour)
+	recent := time.Now().Add(-1 * time.Hour)
+
+	tests := []struct {
+		name              string
+		timestamp         *time.Time
+		secret            string
+		wantPath          string
+		wantErrImportAuth bool
+	}{
+		{
+			name:      "recent event goes to /track",
+			timestamp: &recent,
+			secret:    "secret",
+			wantPath:  "/track",
+		},
+		{
+			name:      "old event falls back to /import with a secret",
+			timestamp: &old,
+			secret:    "secret",
+			wantPath:  "/import",
+		},
+		{
+			name:              "old event without a secret is rejected rather than sent to /track",
+			timestamp:         &old,
+			secret:            "",
+			wantErrImportAuth: true,
+		},
+		{
+			name:      "nil timestamp goes to /track",
+			timestamp: nil,
+			secret:    "secret",
+			wantPath:  "/track",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := trackOkResponse
+			if tt.wantPath == "/import" {
+				resp = okResponse
+			}
+			transport := &fakeTransport{responses: []func(*http.Request) *http.Response{resp}}
+			client := NewFromClientWithSecret(&http.Client{Transport: transport}, "token", tt.secret, "http://mixpanel.test")
+
+			err := client.Track(context.Background(), "user1", "event1", &Event{Timestamp: tt.timestamp})
+
+			if tt.wantErrImportAuth {
+				var authErr *ErrImportAuthRequired
+				if !errors.As(err, &authErr) {
+					t.Fatalf("got err %v, want ErrImportAuthRequired", err)
+				}
+				if transport.requestCount() != 0 {
+					t.Fatalf("expected no request to be sent, got %d", transport.requestCount())
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Track: %v", err)
+			}
+			if transport.requestCount() != 1 {
+				t.Fatalf("got %d requests, want 1", transport.requestCount())
+			}
+			got := transport.requests[0].URL.Path
+			if got != tt.wantPath {
+				t.Fatalf("request path = %q, want %q", got, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestTrack_WithoutImportFallback(t *testing.T) {
+	old := time.Now().Add(-10 * 24 * time.Hour)
+
+	transport := &fakeTransport{responses: []func(*http.Request) *http.Response{trackOkResponse}}
+	client := NewFromClientWithSecret(&http.Client{Transport: transport}, "token", "secret", "http://mixpanel.test", WithoutImportFallback())
+
+	if err := client.Track(context.Background(), "user1", "event1", &Event{Timestamp: &old}); err != nil {
+		t.Fatalf("Track: %v", err)
+	}
+	if got := transport.requests[0].URL.Path; got != "/track" {
+		t.Fatalf("request path = %q, want /track (fallback disabled)", got)
+	}
+}
+
+func TestTrack_CustomImportThreshold(t *testing.T) {
+	justOverAnHour := time.Now().Add(-90 * time.Minute)
+
+	transport := &fakeTransport{responses: []func(*http.Request) *http.Response{okResponse}}
+	client := NewFromClientWithSecret(&http.Client{Transport: transport}, "token", "secret", "http://mixpanel.test", WithImportThreshold(time.Hour))
+
+	if err := client.Track(context.Background(), "user1", "event1", &Event{Timestamp: &justOverAnHour}); err != nil {
+		t.Fatalf("Track: %v", err)
+	}
+	if got := transport.requests[0].URL.Path; got != "/import" {
+		t.Fatalf("request path = %q, want /import (event older than the custom 1h threshold)", got)
+	}
+}
@@ -0,0 +1,352 @@
+package mixpanel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Hooks lets callers observe requests made through RetryTransport or
+// CircuitBreaker, e.g. to emit tracing spans or metrics.
+type Hooks struct {
+	// OnRequest is called immediately before each attempt, including
+	// retries.
+	OnRequest func(req *http.Request)
+
+	// OnResponse is called after each attempt with its result. err is the
+	// error RoundTrip would return for that attempt, if any.
+	OnResponse func(req *http.Request, resp *http.Response, err error)
+
+	// OnRetry is called after a retryable failure, before sleeping for
+	// delay. attempt is 0 for the first retry.
+	OnRetry func(req *http.Request, attempt int, err error, delay time.Duration)
+}
+
+func (h Hooks) onRequest(req *http.Request) {
+	if h.OnRequest != nil {
+		h.OnRequest(req)
+	}
+}
+
+func (h Hooks) onResponse(req *http.Request, resp *http.Response, err error) {
+	if h.OnResponse != nil {
+		h.OnResponse(req, resp, err)
+	}
+}
+
+func (h Hooks) onRetry(req *http.Request, attempt int, err error, delay time.Duration) {
+	if h.OnRetry != nil {
+		h.OnRetry(req, attempt, err, delay)
+	}
+}
+
+// RetryTransport retries requests that fail with a 429, 502, 503 or 504
+// response, or a network error, using jittered exponential backoff. It honors a
+// Retry-After header on 429 responses. Requests are only retried if their
+// body supports GetBody (true for the string/bytes bodies this package
+// sends).
+type RetryTransport struct {
+	// Next is the RoundTripper retried requests are sent through. Defaults
+	// to http.DefaultTransport.
+	Next http.RoundTripper
+
+	// MaxRetries is the maximum number of retries after the initial
+	// attempt. Defaults to 3.
+	MaxRetries int
+
+	// BaseDelay is the delay before the first retry; each subsequent retry
+	// doubles it, plus jitter. Defaults to 500ms.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the backoff delay. Defaults to 30s.
+	MaxDelay time.Duration
+
+	Hooks Hooks
+}
+
+func (t *RetryTransport) next() http.RoundTripper {
+	if t.Next != nil {
+		return t.Next
+	}
+	return http.DefaultTransport
+}
+
+func (t *RetryTransport) maxRetries() int {
+	if t.MaxRetries > 0 {
+		return t.MaxRetries
+	}
+	return 3
+}
+
+func (t *RetryTransport) baseDelay() time.Duration {
+	if t.BaseDelay > 0 {
+		return t.BaseDelay
+	}
+	return 500 * time.Millisecond
+}
+
+func (t *RetryTransport) maxDelay() time.Duration {
+	if t.MaxDelay > 0 {
+		return t.MaxDelay
+	}
+	return 30 * time.Second
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	delay := t.baseDelay()
+
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if attempt > 0 {
+			cloned, err := cloneRequestBody(req)
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = cloned
+		}
+
+		t.Hooks.onRequest(attemptReq)
+		resp, err := t.next().RoundTrip(attemptReq)
+		t.Hooks.onResponse(attemptReq, resp, err)
+
+		replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+		if attempt >= t.maxRetries() || !replayable || !isRetryableResponse(resp, err) {
+			return resp, err
+		}
+
+		wait := delay
+		if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+			if ra, ok := retryAfter(resp); ok {
+				wait = ra
+			}
+		}
+		wait = jitter(wait)
+		if max := t.maxDelay(); wait > max {
+			wait = max
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		t.Hooks.onRetry(attemptReq, attempt, err, wait)
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+
+		delay *= 2
+	}
+}
+
+// cloneRequestBody returns a shallow clone of req with a fresh body obtained
+// via GetBody, so it's safe to replay on a retry.
+func cloneRequestBody(req *http.Request) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		clone.Body = body
+	}
+	return clone, nil
+}
+
+func isRetryableResponse(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAfter parses a Retry-After header expressed as a number of seconds.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	secs, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+// jitter returns d plus up to 20% random jitter, to avoid retry storms from
+// many clients backing off in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+// ErrCircuitOpen is returned by CircuitBreaker.RoundTrip while the circuit is
+// open.
+var ErrCircuitOpen = errors.New("mixpanel: circuit breaker is open")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// CircuitBreaker stops sending requests through Next after FailureThreshold
+// consecutive failures (a 5xx response or a network error), and
+// half-opens (lets a single trial request through) after Cooldown. A
+// successful trial closes the breaker; a failed one reopens it.
+type CircuitBreaker struct {
+	// Next is the RoundTripper requests are sent through while the circuit
+	// is closed or half-open. Defaults to http.DefaultTransport.
+	Next http.RoundTripper
+
+	// FailureThreshold is the number of consecutive failures that opens the
+	// circuit. Defaults to 5.
+	FailureThreshold int
+
+	// Cooldown is how long the circuit stays open before half-opening.
+	// Defaults to 30s.
+	Cooldown time.Duration
+
+	Hooks Hooks
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+func (cb *CircuitBreaker) next() http.RoundTripper {
+	if cb.Next != nil {
+		return cb.Next
+	}
+	return http.DefaultTransport
+}
+
+func (cb *CircuitBreaker) failureThreshold() int {
+	if cb.FailureThreshold > 0 {
+		return cb.FailureThreshold
+	}
+	return 5
+}
+
+func (cb *CircuitBreaker) cooldown() time.Duration {
+	if cb.Cooldown > 0 {
+		return cb.Cooldown
+	}
+	return 30 * time.Second
+}
+
+func (cb *CircuitBreaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !cb.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	cb.Hooks.onRequest(req)
+	resp, err := cb.next().RoundTrip(req)
+	cb.Hooks.onResponse(req, resp, err)
+
+	cb.record(resp, err)
+
+	return resp, err
+}
+
+func (cb *CircuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		if time.Since(cb.openedAt) < cb.cooldown() {
+			return false
+		}
+		// Only this caller performs the open -> half-open transition, so
+		// only it gets the trial request; concurrent callers that also
+		// observe circuitOpen here block on the mutex and then see
+		// circuitHalfOpen below until record() resolves the trial.
+		cb.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		// A trial request is already in flight; reject everyone else until
+		// record() moves the state to closed or back to open.
+		return false
+	default:
+		return true
+	}
+}
+
+func (cb *CircuitBreaker) record(resp *http.Response, err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if err != nil || (resp != nil && resp.StatusCode >= 500) {
+		cb.failures++
+		if cb.state == circuitHalfOpen || cb.failures >= cb.failureThreshold() {
+			cb.state = circuitOpen
+			cb.openedAt = time.Now()
+		}
+		return
+	}
+
+	cb.failures = 0
+	cb.state = circuitClosed
+}
+
+// TimeoutTransport bounds each request to Timeout, on top of whatever
+// deadline its context already carries.
+type TimeoutTransport struct {
+	// Next is the RoundTripper requests are sent through. Defaults to
+	// http.DefaultTransport.
+	Next http.RoundTripper
+
+	Timeout time.Duration
+}
+
+func (t *TimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Timeout <= 0 {
+		next := t.Next
+		if next == nil {
+			next = http.DefaultTransport
+		}
+		return next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.Timeout)
+	req = req.WithContext(ctx)
+
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
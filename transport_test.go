@@ -0,0 +1,216 @@
+package mixpanel
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedTransport returns the next status code in codes for each
+// RoundTrip call, repeating the last one once exhausted.
+type scriptedTransport struct {
+	codes []int
+	calls int
+}
+
+func (s *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	idx := s.calls
+	if idx >= len(s.codes) {
+		idx = len(s.codes) - 1
+	}
+	s.calls++
+
+	return &http.Response{
+		StatusCode: s.codes[idx],
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Header:     make(http.Header),
+	}, nil
+}
+
+func newTestRequest(t *testing.T) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest("GET", "http://mixpanel.test", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	return req
+}
+
+func TestCircuitBreaker_OpensAfterFailureThreshold(t *testing.T) {
+	next := &scriptedTransport{codes: []int{500, 500, 500}}
+	cb := &CircuitBreaker{Next: next, FailureThreshold: 2, Cooldown: time.Hour}
+
+	for i := 0; i < 2; i++ {
+		resp, err := cb.RoundTrip(newTestRequest(t))
+		if err != nil {
+			t.Fatalf("call %d: unexpected error %v", i, err)
+		}
+		if resp.StatusCode != 500 {
+			t.Fatalf("call %d: got status %d, want 500", i, resp.StatusCode)
+		}
+	}
+
+	// The breaker should now be open and reject without calling Next.
+	_, err := cb.RoundTrip(newTestRequest(t))
+	if err != ErrCircuitOpen {
+		t.Fatalf("got err %v, want ErrCircuitOpen", err)
+	}
+	if next.calls != 2 {
+		t.Fatalf("Next called %d times, want 2 (the open call must short-circuit)", next.calls)
+	}
+}
+
+func TestCircuitBreaker_HalfOpensAfterCooldownAndCloses(t *testing.T) {
+	next := &scriptedTransport{codes: []int{500, 500, 200}}
+	cb := &CircuitBreaker{Next: next, FailureThreshold: 2, Cooldown: 10 * time.Millisecond}
+
+	for i := 0; i < 2; i++ {
+		if _, err := cb.RoundTrip(newTestRequest(t)); err != nil {
+			t.Fatalf("call %d: unexpected error %v", i, err)
+		}
+	}
+
+	if _, err := cb.RoundTrip(newTestRequest(t)); err != ErrCircuitOpen {
+		t.Fatalf("expected circuit to be open immediately after threshold, got %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// Cooldown elapsed: the breaker should half-open and let this trial
+	// request through. next.codes[2] == 200, so it should succeed and
+	// close the breaker.
+	resp, err := cb.RoundTrip(newTestRequest(t))
+	if err != nil {
+		t.Fatalf("half-open trial: unexpected error %v", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("half-open trial: got status %d, want 200", resp.StatusCode)
+	}
+
+	cb.mu.Lock()
+	state := cb.state
+	cb.mu.Unlock()
+	if state != circuitClosed {
+		t.Fatalf("breaker state = %v, want closed after a successful half-open trial", state)
+	}
+
+	// A subsequent call should go straight through without being rejected.
+	if _, err := cb.RoundTrip(newTestRequest(t)); err != nil {
+		t.Fatalf("post-close call: unexpected error %v", err)
+	}
+}
+
+// blockingTrialTransport returns 500 for the first failureCalls calls, then
+// blocks on release before returning 200 for every call after that. It lets
+// tests hold a half-open trial in flight while other goroutines race to call
+// RoundTrip concurrently.
+type blockingTrialTransport struct {
+	failureCalls int
+	release      chan struct{}
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (b *blockingTrialTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b.mu.Lock()
+	b.calls++
+	isTrial := b.calls > b.failureCalls
+	b.mu.Unlock()
+
+	code := 500
+	if isTrial {
+		<-b.release
+		code = 200
+	}
+
+	return &http.Response{
+		StatusCode: code,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Header:     make(http.Header),
+	}, nil
+}
+
+// TestCircuitBreaker_HalfOpenTrialIsExclusive is a regression test: while a
+// half-open trial request is in flight, every concurrent caller must be
+// rejected with ErrCircuitOpen rather than also being let through to the
+// still-unhealthy backend.
+func TestCircuitBreaker_HalfOpenTrialIsExclusive(t *testing.T) {
+	next := &blockingTrialTransport{failureCalls: 2, release: make(chan struct{})}
+	cb := &CircuitBreaker{Next: next, FailureThreshold: 2, Cooldown: 10 * time.Millisecond}
+
+	for i := 0; i < 2; i++ {
+		if _, err := cb.RoundTrip(newTestRequest(t)); err != nil {
+			t.Fatalf("call %d: unexpected error %v", i, err)
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	trialDone := make(chan struct{})
+	go func() {
+		defer close(trialDone)
+		if _, err := cb.RoundTrip(newTestRequest(t)); err != nil {
+			t.Errorf("trial call: unexpected error %v", err)
+		}
+	}()
+
+	// Give the trial goroutine time to enter allow() and flip the state to
+	// half-open before racing concurrent callers against it.
+	time.Sleep(10 * time.Millisecond)
+
+	const concurrentCallers = 10
+	var wg sync.WaitGroup
+	rejections := make([]bool, concurrentCallers)
+	for i := 0; i < concurrentCallers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := cb.RoundTrip(newTestRequest(t))
+			rejections[i] = err == ErrCircuitOpen
+		}(i)
+	}
+	wg.Wait()
+
+	for i, rejected := range rejections {
+		if !rejected {
+			t.Errorf("concurrent caller %d was let through while a half-open trial was in flight", i)
+		}
+	}
+
+	close(next.release)
+	<-trialDone
+
+	cb.mu.Lock()
+	state := cb.state
+	cb.mu.Unlock()
+	if state != circuitClosed {
+		t.Fatalf("breaker state = %v, want closed after the trial succeeded", state)
+	}
+}
+
+func TestCircuitBreaker_FailedHalfOpenTrialReopens(t *testing.T) {
+	next := &scriptedTransport{codes: []int{500, 500, 500}}
+	cb := &CircuitBreaker{Next: next, FailureThreshold: 2, Cooldown: 10 * time.Millisecond}
+
+	for i := 0; i < 2; i++ {
+		if _, err := cb.RoundTrip(newTestRequest(t)); err != nil {
+			t.Fatalf("call %d: unexpected error %v", i, err)
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// Half-open trial fails (another 500), so the breaker should reopen
+	// immediately rather than waiting for FailureThreshold more failures.
+	if _, err := cb.RoundTrip(newTestRequest(t)); err != nil {
+		t.Fatalf("half-open trial: unexpected error %v", err)
+	}
+
+	if _, err := cb.RoundTrip(newTestRequest(t)); err != ErrCircuitOpen {
+		t.Fatalf("expected breaker to reopen after a failed half-open trial, got %v", err)
+	}
+}